@@ -3,9 +3,6 @@ package cryp
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -16,65 +13,39 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
-)
 
-const SignatureSize = sha256.Size * 2 // hex encoded SHA-256
+	"github.com/jasonmoo/cryp/sign"
+	"golang.org/x/crypto/openpgp"
+)
 
 var sha256HexRegexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
 
-// Decrypt takes data and a key and outputs decrypted data and any possible errors
-// The key can be any length or empty (not recommended).  A SHA-512/256 key is generated
-// from the supplied key ensuring the 32 byte AES-256 key length requirement is met.
-// Once decrypted, the data is decompressed using gzip.
-func Decrypt(data []byte, sig string, key []byte) ([]byte, error) {
-
-	// should never happen
-	if len(data) < aes.BlockSize {
-		return nil, errors.New("insufficient data to decrypt")
-	}
-
-	sig_mac, err := hex.DecodeString(sig)
-	if err != nil {
-		return nil, err
-	}
-
-	h := hmac.New(sha256.New, key)
-	h.Write(data)
-	data_mac := h.Sum(nil)
-	if !hmac.Equal(sig_mac, data_mac) {
-		return nil, errors.New("signature does not match data")
-	}
-
-	// generate a 32 byte key from the variable length key supplied
-	aes256Key := generate32ByteKey(key)
-
-	block, err := aes.NewCipher(aes256Key)
-	if err != nil {
-		return nil, err
-	}
-
-	iv := data[:aes.BlockSize]
-	dectext := data[aes.BlockSize:]
-	cfb := cipher.NewCFBDecrypter(block, iv)
-	cfb.XORKeyStream(dectext, dectext)
+// Decrypt takes data and a key and outputs decrypted data and any possible
+// errors. It is a thin wrapper around DecryptStream that buffers data and
+// the resulting plaintext in memory; callers handling large files should
+// use DecryptStream directly.
+func Decrypt(data []byte, key []byte) ([]byte, error) {
 
-	r, err := gzip.NewReader(bytes.NewReader(dectext))
-	if err != nil {
+	buf := &bytes.Buffer{}
+	if err := DecryptStream(buf, bytes.NewReader(data), key); err != nil {
 		return nil, err
 	}
 
-	return ioutil.ReadAll(r)
+	return buf.Bytes(), nil
 
 }
 
-// DecryptFile ensures the file name (SHA-256 checksum of contents) matches the checksum of
-// the contents and passes the file contents to Decrypt.  It parses the decrypted tar payload
-// and attempts to restore the file to its original form (name, contents, mode, mod time)
-// It returns the original file path and error if occurred
+// DecryptFile ensures the file name (HMAC-SHA256 of the encrypted contents, keyed with key)
+// matches the contents before streaming them through DecryptStream and the decrypted tar
+// payload, restoring every entry it contains - regular file, symlink, or directory,
+// with its original name, contents, mode, mod time, ownership, and extended attributes.
+// This reverses both EncryptFile's single-entry archives and EncryptPath's whole-tree ones.
+// It returns the path of the first (for EncryptFile, only) entry restored, and error if occurred.
 func DecryptFile(path string, key []byte) (string, error) {
 
-	// expecting file name to be sha256 hex encoded hash of
+	// expecting file name to be hex encoded HMAC-SHA256 of
 	// 32ebb1abcc1c601ceb9c4e3c4faba0caa5b85bb98c4f1e6612c40faa528a91c9 (64 chars long)
 	if !sha256HexRegexp.MatchString(filepath.Base(path)) {
 		return "", errors.New("invalid file name, expected SHA-256 hash")
@@ -94,78 +65,272 @@ func DecryptFile(path string, key []byte) (string, error) {
 	start := time.Now()
 	fmt.Fprint(LogOutput, "Decrypting ", path)
 
-	data, err := ioutil.ReadFile(path)
+	src, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
+	defer src.Close()
 
-	sig := filepath.Base(path)
-	dec_data, err := Decrypt(data, sig, key)
-	if err != nil {
-		return "", err
-	}
-
-	tr := tar.NewReader(bytes.NewReader(dec_data))
-	hdr, err := tr.Next()
-	if err != nil && err != io.EOF {
+	h := hmac.New(sha256.New, key)
+	if _, err := io.Copy(h, src); err != nil {
 		return "", err
 	}
-
-	orig_file_path := filepath.Join(filepath.Dir(path), hdr.Name)
-	orig_file, err := os.OpenFile(orig_file_path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, os.FileMode(hdr.Mode))
-	if err != nil {
-		return "", err
+	if hex.EncodeToString(h.Sum(nil)) != filepath.Base(path) {
+		return "", errors.New("file name does not match HMAC of contents")
 	}
-	if n, err := io.Copy(orig_file, tr); err != nil {
-		orig_file.Close()
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
 		return "", err
-	} else if n != hdr.Size {
-		orig_file.Close()
-		return "", io.ErrShortWrite
 	}
-	if err := orig_file.Close(); err != nil {
-		return "", err
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(DecryptStream(pw, src, key))
+	}()
+
+	tr := tar.NewReader(pr)
+
+	var first_path string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		entry_path := filepath.Join(filepath.Dir(path), hdr.Name)
+		if first_path == "" {
+			first_path = entry_path
+		}
+		if err := os.MkdirAll(filepath.Dir(entry_path), 0700); err != nil {
+			return "", err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, entry_path); err != nil {
+				return "", err
+			}
+		case tar.TypeDir:
+			if err := os.MkdirAll(entry_path, os.FileMode(hdr.Mode)); err != nil {
+				return "", err
+			}
+		default:
+			entry_file, err := os.OpenFile(entry_path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				return "", err
+			}
+			if n, err := io.Copy(entry_file, tr); err != nil {
+				entry_file.Close()
+				return "", err
+			} else if n != hdr.Size {
+				entry_file.Close()
+				return "", io.ErrShortWrite
+			}
+			if err := entry_file.Close(); err != nil {
+				return "", err
+			}
+		}
+
+		if err := applyTarMetadata(entry_path, hdr); err != nil {
+			return "", err
+		}
+
+		// os.Chtimes follows symlinks, and there's no portable way to set
+		// a symlink's own mtime, so its target's time is left alone.
+		if hdr.Typeflag != tar.TypeSymlink {
+			if err := os.Chtimes(entry_path, time.Now(), hdr.ModTime); err != nil {
+				return "", err
+			}
+		}
 	}
-	if err := os.Chtimes(orig_file_path, time.Now(), hdr.ModTime); err != nil {
-		return "", err
+
+	if first_path == "" {
+		return "", errors.New("cryp: empty archive")
 	}
 
 	fmt.Fprintln(LogOutput, " ...", time.Since(start))
 
-	return orig_file_path, nil
+	return first_path, nil
 
 }
 
-// DecryptDirFiles takes a directory and a key, and searches recursively,
-// for any files that are named a SHA-256 checksum to decrypt.  It passes each
-// file to DecryptFile, and removes the encrypted original. Any files that
-// do not match the SHA-256 checksum are left as-is.
+// DecryptDirFiles reverses EncryptDirFiles: it takes a directory and a key
+// and recursively decrypts every EncryptName-encrypted entry below dir
+// (dir itself is left addressed by its existing name) back to its real
+// name, decrypting regular files' contents with DecryptFile along the way.
+// Named pipes, sockets, and devices are left as-is.
 func DecryptDirFiles(dir string, key []byte) error {
+	return DecryptDirFilesVerified(dir, key, nil)
+}
+
+// DecryptDirFilesVerified is DecryptDirFiles with an optional keyring: any
+// "<name>.sig" sibling found alongside a ciphertext is checked with
+// sign.VerifyEncrypted against keyring before that ciphertext is decrypted,
+// and decryption stops on the first signature that fails to verify. A nil
+// keyring skips verification entirely, same as DecryptDirFiles.
+func DecryptDirFilesVerified(dir string, key []byte, keyring openpgp.EntityList) error {
+
+	nameKey, err := deriveNameKey(key)
+	if err != nil {
+		return err
+	}
+
+	return decryptDirTree(dir, filepath.Base(dir), nameKey, key, keyring)
+
+}
+
+// decryptDirTree decrypts the names and contents of every entry directly
+// inside dir, then renames subdirectories to their real names only once
+// their own children are done - mirroring the order encryptDirTree used to
+// produce them. dirName is dir's own plaintext name - dir is never itself
+// renamed by EncryptDirFiles, so dirName is always recoverable, and using
+// only this one path component (rather than dir's full, absolute, on-disk
+// path) to tweak its children matches encryptDirTree regardless of
+// whether the tree has since been moved, copied elsewhere, or
+// DecryptDirFiles is invoked with a different ancestor than
+// EncryptDirFiles originally was.
+func decryptDirTree(dir, dirName string, nameKey, key []byte, keyring openpgp.EntityList) error {
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// *.sig files are signatures paired with a same-named ciphertext, not
+	// independent entries: they're read upfront and verified alongside
+	// their ciphertext rather than walked (and name-decrypted) themselves.
+	sigs := make(map[string][]byte)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), sigFileExt) {
+			data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+			sigs[strings.TrimSuffix(entry.Name(), sigFileExt)] = data
+		}
+	}
+
+	tweak := dirTweak(nameKey, dirName)
 
-	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+	for _, entry := range entries {
 
-		// continue into dirs
-		if info.IsDir() {
-			return nil
+		if strings.HasSuffix(entry.Name(), sigFileExt) {
+			continue
 		}
 
-		// expecting file name to be sha256 hex encoded hash of
-		// 32ebb1abcc1c601ceb9c4e3c4faba0caa5b85bb98c4f1e6612c40faa528a91c9 (64 chars long)
-		if !sha256HexRegexp.MatchString(filepath.Base(path)) {
-			fmt.Fprintln(LogOutput, "Skipping", path)
-			return nil
+		// named pipes, sockets, and devices are left as-is
+		if entry.Mode()&os.ModeType&^os.ModeSymlink&^os.ModeDir != 0 {
+			continue
 		}
 
-		if _, err := DecryptFile(path, key); err != nil {
-			return err
+		srcPath := filepath.Join(dir, entry.Name())
+
+		name, nameErr := decryptNameTweaked(entry.Name(), nameKey, tweak)
+
+		// A name that doesn't even carry encNamePrefix was never encrypted
+		// - directories in particular are walked either way, encrypted or
+		// not, so a tree that mixes encrypted and plain subtrees still
+		// reaches the encrypted ones further down. But a name that IS
+		// marked as ciphertext and still fails to decrypt means something
+		// is actually wrong - wrong key, a mismatched tweak, or corruption
+		// - and must not be swallowed as "not encrypted", or the entire
+		// subtree silently stays encrypted on disk with DecryptDirFiles
+		// reporting success.
+		if nameErr != nil && base32NameRegexp.MatchString(entry.Name()) {
+			return fmt.Errorf("cryp: %s: failed to decrypt name: %w", srcPath, nameErr)
 		}
 
-		if err := os.Remove(path); err != nil {
-			return err
+		childDirName := entry.Name()
+		if nameErr == nil {
+			childDirName = name
 		}
 
-		return nil
+		// Directories are always walked, encrypted or not, so a tree
+		// that mixes encrypted and plain subtrees still reaches the
+		// encrypted ones further down; only the rename is conditional
+		// on the name actually being ciphertext.
+		if entry.IsDir() {
+			if err := decryptDirTree(srcPath, childDirName, nameKey, key, keyring); err != nil {
+				return err
+			}
+			if nameErr != nil {
+				fmt.Fprintln(LogOutput, "Skipping", srcPath)
+				continue
+			}
+			if err := os.Rename(srcPath, filepath.Join(dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if nameErr != nil {
+			fmt.Fprintln(LogOutput, "Skipping", srcPath)
+			continue
+		}
+
+		switch {
+		case entry.Mode()&os.ModeSymlink != 0:
+			if err := os.Rename(srcPath, filepath.Join(dir, name)); err != nil {
+				return err
+			}
+
+		default:
+			sigPath := srcPath + sigFileExt
+			if signature, ok := sigs[entry.Name()]; ok {
+				if keyring != nil {
+					ciphertext, err := ioutil.ReadFile(srcPath)
+					if err != nil {
+						return err
+					}
+					if err := sign.VerifyEncrypted(ciphertext, signature, keyring); err != nil {
+						return fmt.Errorf("cryp: %s: %w", srcPath, err)
+					}
+				}
+				if err := os.Remove(sigPath); err != nil {
+					return err
+				}
+			}
+
+			hashName, err := hmacFileName(srcPath, key)
+			if err != nil {
+				return err
+			}
+			hashPath := filepath.Join(dir, hashName)
+			if err := os.Rename(srcPath, hashPath); err != nil {
+				return err
+			}
+			if _, err := DecryptFile(hashPath, key); err != nil {
+				return err
+			}
+			if err := os.Remove(hashPath); err != nil {
+				return err
+			}
+		}
+
+	}
+
+	return nil
+
+}
+
+// hmacFileName computes the HMAC-SHA256 (keyed with key) of path's
+// contents, hex encoded - the name EncryptFile gives its ciphertext and
+// DecryptFile requires as input.
+func hmacFileName(path string, key []byte) (string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := hmac.New(sha256.New, key)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
 
-	})
+	return hex.EncodeToString(h.Sum(nil)), nil
 
 }
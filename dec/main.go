@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/base64"
-	"io/ioutil"
 	"log"
 	"os"
 
@@ -16,24 +15,10 @@ func main() {
 		log.Fatal("CRYP_KEY not set in environment")
 	}
 
-	input, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, os.Stdin))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if len(input) < cryp.SignatureSize {
-		log.Fatal("data too short to decrypt")
-	}
-
-	// extract sig prefix from input data
-	sig := string(input[:cryp.SignatureSize])
-	input = input[cryp.SignatureSize:]
+	dec := base64.NewDecoder(base64.StdEncoding, os.Stdin)
 
-	output, err := cryp.Decrypt(input, sig, []byte(key))
-	if err != nil {
+	if err := cryp.DecryptStream(os.Stdout, dec, []byte(key)); err != nil {
 		log.Fatal(err)
 	}
 
-	os.Stdout.Write(output)
-
 }
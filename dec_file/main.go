@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/jasonmoo/cryp"
+	"github.com/jasonmoo/cryp/sign"
+	"golang.org/x/crypto/openpgp"
+)
+
+func main() {
+
+	key, exists := os.LookupEnv("CRYP_KEY")
+	if !exists {
+		log.Fatal("CRYP_KEY not set in environment")
+	}
+
+	keyring, err := loadKeyring()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, path := range os.Args[1:] {
+		if keyring != nil {
+			if err := verify(path, keyring); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if _, err := cryp.DecryptFile(path, []byte(key)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+}
+
+// loadKeyring reads the armored keyring at CRYP_PGP_KEYRING, if set. A nil
+// keyring and nil error means CRYP_PGP_KEYRING wasn't set, so files decrypt
+// without checking for a paired signature.
+func loadKeyring() (openpgp.EntityList, error) {
+
+	path, exists := os.LookupEnv("CRYP_PGP_KEYRING")
+	if !exists {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return openpgp.ReadArmoredKeyRing(f)
+
+}
+
+// verify checks path's paired "<path>.sig", if one exists, against keyring
+// before path is decrypted. A missing .sig is not an error: not every
+// encrypted file is expected to be signed.
+func verify(path string, keyring openpgp.EntityList) error {
+
+	signature, err := ioutil.ReadFile(path + ".sig")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	ciphertext, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return sign.VerifyEncrypted(ciphertext, signature, keyring)
+
+}
@@ -3,14 +3,7 @@ package cryp
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/hmac"
-	"crypto/rand"
-	"crypto/sha256"
 	"crypto/sha512"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -19,121 +12,186 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/jasonmoo/cryp/sign"
+	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/scrypt"
 )
 
+// sigFileExt is the suffix EncryptFileSigned gives the detached signature it
+// writes alongside an encrypted file, and the suffix DecryptDirFilesVerified
+// looks for to pair a ciphertext back up with its signature.
+const sigFileExt = ".sig"
+
 // Common actions are printed to stdout.  These can be silenced
 // by setting LogOutput = ioutil.Discard
 var LogOutput io.Writer = os.Stdout
 
-// Encrypt takes data and a key and outputs encrypted data, it's HMAC SHA-256 signature
-// and any possible errors. The key can be any length or empty (not recommended).
-// The data can be any length or empty.  Scrypt for the 32 byte AES-256 key derivation.
-// The data is compressed using gzip prior to encryption.  Raw byte output will need
-// to be hex/base64 encoded before it is printable.
-func Encrypt(data []byte, key []byte) ([]byte, string, error) {
-
-	// generate a 32 byte key from the variable length key supplied
-	aes256Key := generate32ByteKey(key)
+// Encrypt takes data and a key and outputs authenticated ciphertext and any
+// possible errors. The key can be any length or empty (not recommended).
+// The data can be any length or empty. It is a thin wrapper around
+// EncryptStream that buffers data and the resulting ciphertext in memory;
+// callers handling large files should use EncryptStream directly. Raw byte
+// output will need to be hex/base64 encoded before it is printable.
+func Encrypt(data []byte, key []byte) ([]byte, error) {
+	return EncryptWithOptions(data, key, DefaultOptions())
+}
 
-	block, err := aes.NewCipher(aes256Key)
-	if err != nil {
-		return nil, "", err
-	}
+// EncryptWithOptions is Encrypt with control over the cipher, scrypt cost,
+// and whether the data is gzipped before it's sealed. A nil opts is
+// equivalent to DefaultOptions.
+func EncryptWithOptions(data []byte, key []byte, opts *Options) ([]byte, error) {
 
 	buf := &bytes.Buffer{}
-	w, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
-	if err != nil {
-		return nil, "", err
-	}
-	if _, err := w.Write(data); err != nil {
-		return nil, "", err
-	}
-	if err := w.Close(); err != nil {
-		return nil, "", err
-	}
-
-	ciphertext := make([]byte, aes.BlockSize+buf.Len())
-
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return nil, "", err
+	if err := EncryptStreamWithOptions(buf, bytes.NewReader(data), key, opts); err != nil {
+		return nil, err
 	}
 
-	cfb := cipher.NewCFBEncrypter(block, iv)
-	cfb.XORKeyStream(ciphertext[aes.BlockSize:], buf.Bytes())
-
-	h := hmac.New(sha256.New, key)
-	h.Write(ciphertext)
-	sig := hex.EncodeToString(h.Sum(nil))
+	return buf.Bytes(), nil
 
-	return ciphertext, sig, nil
+}
 
+// EncryptFile is EncryptFileWithOptions with DefaultOptions.
+func EncryptFile(path string, key []byte) (string, error) {
+	return EncryptFileWithOptions(path, key, DefaultOptions())
 }
 
-// EncryptFile writes a file's name, size, mode, mod time, and contents
-// in tar format and passes it to Encrypt. A new file is created
-// that is named the SHA-256 checksum of the encrypted output.
+// EncryptFileWithOptions streams a file's full POSIX metadata (name, size,
+// mode, mod time, ownership, symlink target, and extended attributes) and
+// contents in tar format through EncryptStreamWithOptions so files far
+// larger than RAM never need to be buffered whole. A new file is created
+// alongside the original, named with the HMAC-SHA256 (keyed with key) of
+// the encrypted output so its name both looks opaque and lets DecryptFile
+// cheaply notice a renamed or corrupted ciphertext before it ever touches
+// the AEAD layer. path may be a regular file, a symlink, or a directory
+// (encrypted empty, with no children - see EncryptPath to archive a whole
+// tree). A nil opts is equivalent to DefaultOptions.
 // It returns the new file path and error if occurred
-func EncryptFile(path string, key []byte) (string, error) {
+func EncryptFileWithOptions(path string, key []byte, opts *Options) (string, error) {
 
-	info, err := os.Stat(path)
+	info, err := os.Lstat(path)
 	if err != nil {
 		return "", err
 	}
 
 	// unable to encrypt these files
-	// ModeType = ModeDir | ModeSymlink | ModeNamedPipe | ModeSocket | ModeDevice
-	if info.Mode()&os.ModeType != 0 {
+	if info.Mode()&os.ModeType&^os.ModeSymlink&^os.ModeDir != 0 {
 		return "", errors.New("invalid file type")
 	}
 
 	start := time.Now()
 	fmt.Fprint(LogOutput, "Encrypting ", path)
 
-	data, err := ioutil.ReadFile(path)
+	new_file_path, err := encryptTarStream(filepath.Dir(path), key, opts, func(tw *tar.Writer) error {
+		return writeTarEntry(tw, info.Name(), path, info)
+	})
 	if err != nil {
 		return "", err
 	}
 
-	// Create a new tar archive.
-	buf := &bytes.Buffer{}
-	tw := tar.NewWriter(buf)
+	fmt.Fprintln(LogOutput, " ...", time.Since(start))
 
-	hdr := &tar.Header{
-		Name:    info.Name(),        // string    // name of header file entry
-		Mode:    int64(info.Mode()), // int64     // permission and mode bits
-		Size:    info.Size(),        // int64     // length in bytes
-		ModTime: info.ModTime(),     // time.Time // modified time
-	}
-	if err := tw.WriteHeader(hdr); err != nil {
+	return new_file_path, nil
+
+}
+
+// EncryptFileSigned is EncryptFileSignedWithOptions with DefaultOptions.
+func EncryptFileSigned(path string, key []byte, signer *openpgp.Entity) (string, error) {
+	return EncryptFileSignedWithOptions(path, key, signer, DefaultOptions())
+}
+
+// EncryptFileSignedWithOptions is EncryptFileWithOptions followed by a
+// detached OpenPGP signature, made with signer, over the resulting
+// ciphertext. The signature is written alongside the encrypted file as
+// <new file>.sig via sign.SignEncrypted, and is independent of cryp's own
+// HMAC filename check: it proves the file came from signer, not merely
+// that its contents weren't corrupted.
+func EncryptFileSignedWithOptions(path string, key []byte, signer *openpgp.Entity, opts *Options) (string, error) {
+
+	new_file_path, err := EncryptFileWithOptions(path, key, opts)
+	if err != nil {
 		return "", err
 	}
-	if _, err := tw.Write(data); err != nil {
+
+	ciphertext, err := ioutil.ReadFile(new_file_path)
+	if err != nil {
 		return "", err
 	}
-	if err := tw.Close(); err != nil {
+
+	signature, err := sign.SignEncrypted(ciphertext, signer)
+	if err != nil {
 		return "", err
 	}
 
-	// encrypt tar archive
-	encrypted_data, sig, err := Encrypt(buf.Bytes(), key)
-	if err != nil {
+	if err := ioutil.WriteFile(new_file_path+sigFileExt, signature, 0400); err != nil {
 		return "", err
 	}
 
-	// create new file using signature as name
-	new_file_path := filepath.Join(filepath.Dir(path), sig)
-	new_file, err := os.OpenFile(new_file_path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_SYNC, 0400)
+	return new_file_path, nil
+
+}
+
+// EncryptPath is EncryptPathWithOptions with DefaultOptions.
+func EncryptPath(path string, key []byte) (string, error) {
+	return EncryptPathWithOptions(path, key, DefaultOptions())
+}
+
+// EncryptPathWithOptions encrypts path, choosing the representation suited
+// to its type: EncryptFileWithOptions for a single regular file or symlink,
+// or - for a directory - a single encrypted archive of the whole tree (one
+// multi-entry tar, rather than one encrypted blob per file), preserving
+// every entry's type, symlink target, ownership, and extended attributes
+// along the way. A nil opts is equivalent to DefaultOptions.
+// It returns the new archive's path and error if occurred.
+func EncryptPathWithOptions(path string, key []byte, opts *Options) (string, error) {
+
+	info, err := os.Lstat(path)
 	if err != nil {
 		return "", err
 	}
-	if n, err := new_file.Write(encrypted_data); err != nil {
-		return "", err
-	} else if n != len(encrypted_data) {
-		return "", io.ErrShortWrite
+
+	if !info.IsDir() {
+		return EncryptFileWithOptions(path, key, opts)
 	}
-	if err := new_file.Close(); err != nil {
+
+	return encryptTree(path, key, opts)
+
+}
+
+// encryptTree walks dir and writes every entry below it - and dir itself -
+// into a single tar archive, named in the archive relative to dir's parent
+// so DecryptFile can recreate the tree rooted at dir's own name.
+func encryptTree(dir string, key []byte, opts *Options) (string, error) {
+
+	start := time.Now()
+	fmt.Fprint(LogOutput, "Encrypting ", dir)
+
+	base := filepath.Base(dir)
+
+	new_file_path, err := encryptTarStream(filepath.Dir(dir), key, opts, func(tw *tar.Writer) error {
+		return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			// named pipes, sockets, and devices have no meaningful
+			// encrypted form
+			if info.Mode()&os.ModeType&^os.ModeSymlink&^os.ModeDir != 0 {
+				return nil
+			}
+
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			name := base
+			if rel != "." {
+				name = filepath.Join(base, rel)
+			}
+
+			return writeTarEntry(tw, name, path, info)
+		})
+	})
+	if err != nil {
 		return "", err
 	}
 
@@ -143,49 +201,110 @@ func EncryptFile(path string, key []byte) (string, error) {
 
 }
 
-// EncryptDirFiles takes a directory and a key and searches, recursively,
-// for any files to encrypt and passes it to EncryptFile, replacing the
-// existing file with the new encrypted version. All directories,
-// symlinks, named pipes, sockets, and devices are left as-is.
+// EncryptDirFiles is EncryptDirFilesWithOptions with DefaultOptions.
 func EncryptDirFiles(dir string, key []byte) error {
+	return EncryptDirFilesWithOptions(dir, key, DefaultOptions())
+}
 
-	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+// EncryptDirFilesWithOptions takes a directory and a key and recursively
+// encrypts its contents in place: every regular file's contents are passed
+// to EncryptFileWithOptions, and every file, directory, and symlink name
+// below dir (dir itself keeps its name) is replaced with its EncryptName
+// ciphertext, tweaked by the name of the directory holding it so identical
+// names in differently named directories don't produce identical
+// ciphertext names (directories sharing a name share a tweak). Named pipes,
+// sockets, and devices are left as-is. A nil opts is equivalent to
+// DefaultOptions.
+func EncryptDirFilesWithOptions(dir string, key []byte, opts *Options) error {
+
+	nameKey, err := deriveNameKey(key)
+	if err != nil {
+		return err
+	}
 
-		// Skip these types
-		// ModeType = ModeDir | ModeSymlink | ModeNamedPipe | ModeSocket | ModeDevice
-		if info.Mode()&os.ModeType != 0 {
-			return nil
-		}
+	return encryptDirTree(dir, filepath.Base(dir), nameKey, key, opts)
 
-		if _, err := EncryptFile(path, key); err != nil {
-			return err
+}
+
+// encryptDirTree encrypts the names and contents of every entry directly
+// inside dir, recursing into subdirectories after renaming them. dirName is
+// dir's own plaintext name - dir is never itself renamed by
+// EncryptDirFiles, so every entry's tweak is derived from just that one
+// path component rather than dir's full, absolute, on-disk path, and stays
+// reproducible at decrypt time regardless of where the tree lives on disk
+// by then or which ancestor DecryptDirFiles is invoked with.
+func encryptDirTree(dir, dirName string, nameKey, key []byte, opts *Options) error {
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	tweak := dirTweak(nameKey, dirName)
+
+	for _, entry := range entries {
+
+		// named pipes, sockets, and devices are left as-is
+		if entry.Mode()&os.ModeType&^os.ModeSymlink&^os.ModeDir != 0 {
+			continue
 		}
 
-		if err := os.Remove(path); err != nil {
+		srcPath := filepath.Join(dir, entry.Name())
+
+		encName, err := encryptNameTweaked(entry.Name(), nameKey, tweak)
+		if err != nil {
 			return err
 		}
+		dstPath := filepath.Join(dir, encName)
+
+		switch {
+		case entry.IsDir():
+			if err := os.Rename(srcPath, dstPath); err != nil {
+				return err
+			}
+			if err := encryptDirTree(dstPath, entry.Name(), nameKey, key, opts); err != nil {
+				return err
+			}
+
+		case entry.Mode()&os.ModeSymlink != 0:
+			if err := os.Rename(srcPath, dstPath); err != nil {
+				return err
+			}
+
+		default:
+			encPath, err := EncryptFileWithOptions(srcPath, key, opts)
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(srcPath); err != nil {
+				return err
+			}
+			if err := os.Rename(encPath, dstPath); err != nil {
+				return err
+			}
+		}
 
-		return nil
+	}
 
-	})
+	return nil
 
 }
 
-func generate32ByteKey(input []byte) []byte {
-
-	// The recommended parameters for interactive logins as of 2009 are N=16384, r=8, p=1.
-	const (
-		// N is a CPU/memory cost parameter, which must be a power of two greater than 1.
-		N = 16 << 10
-		// r and p must satisfy r * p < 2³⁰
-		r = 8
-		p = 1
-		// AES-256 requires 32 byte key
-		keyLen = 32
-	)
+// The recommended parameters for interactive logins as of 2009 are
+// N=16384, r=8, p=1. They're shared by generate32ByteKey and the streaming
+// AEAD's per-file key derivation so both paths cost the same to brute force.
+const (
+	// scryptN is a CPU/memory cost parameter, which must be a power of two greater than 1.
+	scryptN = 16 << 10
+	// scryptR and scryptP must satisfy r * p < 2³⁰
+	scryptR = 8
+	scryptP = 1
+	// aesKeyLen is the AES-256 key length in bytes.
+	aesKeyLen = 32
+)
 
+func generate32ByteKey(input []byte) []byte {
 	salt := sha512.Sum512(input)
-	key, _ := scrypt.Key(input, salt[:], N, r, p, keyLen)
+	key, _ := scrypt.Key(input, salt[:], scryptN, scryptR, scryptP, aesKeyLen)
 	return key
-
 }
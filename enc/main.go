@@ -2,8 +2,6 @@ package main
 
 import (
 	"encoding/base64"
-	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 
@@ -17,21 +15,14 @@ func main() {
 		log.Fatal("CRYP_KEY not set in environment")
 	}
 
-	data, err := ioutil.ReadAll(os.Stdin)
-	if err != nil {
+	enc := base64.NewEncoder(base64.StdEncoding, os.Stdout)
+
+	if err := cryp.EncryptStream(enc, os.Stdin, []byte(key)); err != nil {
 		log.Fatal(err)
 	}
-
-	output, sig, err := cryp.Encrypt(data, []byte(key))
-	if err != nil {
+	if err := enc.Close(); err != nil {
 		log.Fatal(err)
 	}
-
-	// prepend sig to encrypted data before base64 encoding
-	buf := make([]byte, 0, len(sig)+len(output))
-	buf = append(buf, sig...)
-	buf = append(buf, output...)
-
-	fmt.Println(base64.StdEncoding.EncodeToString(buf))
+	os.Stdout.Write([]byte("\n"))
 
 }
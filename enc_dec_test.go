@@ -2,9 +2,6 @@ package cryp
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -12,6 +9,9 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/jasonmoo/cryp/sign"
+	"golang.org/x/crypto/openpgp"
 )
 
 func init() {
@@ -140,6 +140,123 @@ func TestEncDecFile(t *testing.T) {
 
 }
 
+func TestEncDecFileSymlink(t *testing.T) {
+
+	var key = []byte("key")
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test_enc_dec_symlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target.txt")
+	if err := ioutil.WriteFile(target, []byte("target contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("target.txt", link); err != nil {
+		t.Fatal(err)
+	}
+
+	new_path, err := EncryptFile(link, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(new_path)
+
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+
+	orig_path, err := DecryptFile(new_path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(orig_path)
+
+	if orig_path != link {
+		t.Errorf("Expected %q, got %q", link, orig_path)
+	}
+
+	info, err := os.Lstat(orig_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Expected a symlink, got mode %v", info.Mode())
+	}
+
+	dest, err := os.Readlink(orig_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest != "target.txt" {
+		t.Errorf("Expected link target %q, got %q", "target.txt", dest)
+	}
+
+}
+
+func TestEncDecPathDirectory(t *testing.T) {
+
+	var key = []byte("key")
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test_enc_dec_path_dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree := filepath.Join(dir, "tree")
+	if err := os.MkdirAll(filepath.Join(tree, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tree, "sub", "file.txt"), []byte("nested file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file.txt", filepath.Join(tree, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	new_path, err := EncryptPath(tree, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(new_path)
+
+	if err := os.RemoveAll(tree); err != nil {
+		t.Fatal(err)
+	}
+
+	orig_path, err := DecryptFile(new_path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(orig_path)
+
+	if orig_path != tree {
+		t.Errorf("Expected %q, got %q", tree, orig_path)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tree, "sub", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "nested file" {
+		t.Errorf("Expected %q, got %q", "nested file", data)
+	}
+
+	dest, err := os.Readlink(filepath.Join(tree, "sub", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest != "file.txt" {
+		t.Errorf("Expected link target %q, got %q", "file.txt", dest)
+	}
+
+}
+
 func TestEncDecDirectory(t *testing.T) {
 
 	const testSubDir = "test_enc_dec_directory"
@@ -187,8 +304,8 @@ func TestEncDecDirectory(t *testing.T) {
 
 		atLeastOneFileChecked = true
 
-		if !sha256HexRegexp.MatchString(filepath.Base(path)) {
-			return fmt.Errorf("Expected sha256 hash filename, got %q", filepath.Base(path))
+		if strings.HasPrefix(filepath.Base(path), TextFile) {
+			return fmt.Errorf("Expected encrypted name, still found %q", filepath.Base(path))
 		}
 
 		// ensure we write with user read only perm
@@ -196,19 +313,6 @@ func TestEncDecDirectory(t *testing.T) {
 			return fmt.Errorf("Expected %#o, got %#o", 0400, info.Mode().Perm())
 		}
 
-		data, err := ioutil.ReadFile(path)
-		if err != nil {
-			return err
-		}
-
-		h := hmac.New(sha256.New, key)
-		h.Write(data)
-		data_hash := hex.EncodeToString(h.Sum(nil))
-
-		if data_hash != filepath.Base(path) {
-			return fmt.Errorf("Corruption detected in %s", path)
-		}
-
 		return nil
 
 	}); err != nil {
@@ -267,3 +371,159 @@ func TestEncDecDirectory(t *testing.T) {
 	}
 
 }
+
+func TestEncryptFileSigned(t *testing.T) {
+
+	var key = []byte("key")
+
+	signer, err := openpgp.NewEntity("cryp test", "", "cryp-test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test_enc_file_signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file.txt")
+	if err := ioutil.WriteFile(path, []byte("signed file contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	new_path, err := EncryptFileSigned(path, key, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig_path := new_path + sigFileExt
+	if _, err := os.Stat(sig_path); err != nil {
+		t.Fatalf("expected signature file %q: %v", sig_path, err)
+	}
+
+	ciphertext, err := ioutil.ReadFile(new_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ioutil.ReadFile(sig_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := openpgp.EntityList{signer}
+	if err := sign.VerifyEncrypted(ciphertext, signature, keyring); err != nil {
+		t.Errorf("expected signature to verify, got %v", err)
+	}
+
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sign.VerifyEncrypted(ciphertext, signature, openpgp.EntityList{other}); err == nil {
+		t.Error("expected signature to fail to verify against an unrelated key")
+	}
+
+}
+
+func TestDecryptDirFilesVerified(t *testing.T) {
+
+	var key = []byte("key")
+
+	signer, err := openpgp.NewEntity("cryp test", "", "cryp-test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test_dec_dir_verified")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("dir file contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EncryptDirFiles(dir, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// EncryptDirFiles doesn't sign anything itself, so sign whatever
+	// ciphertext it produced and drop the signature alongside it under
+	// the same encrypted name, the way a signing-aware caller would.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected exactly one encrypted entry, got %d", len(entries))
+	}
+	encPath := filepath.Join(dir, entries[0].Name())
+
+	ciphertext, err := ioutil.ReadFile(encPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := sign.SignEncrypted(ciphertext, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(encPath+sigFileExt, signature, 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := openpgp.EntityList{signer}
+	if err := DecryptDirFilesVerified(dir, key, keyring); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "dir file contents" {
+		t.Errorf("expected %q, got %q", "dir file contents", data)
+	}
+
+}
+
+func TestDecryptDirFilesVerifiedTamperedSignature(t *testing.T) {
+
+	var key = []byte("key")
+
+	signer, err := openpgp.NewEntity("cryp test", "", "cryp-test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test_dec_dir_verified_tampered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("dir file contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EncryptDirFiles(dir, key); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encPath := filepath.Join(dir, entries[0].Name())
+
+	if err := ioutil.WriteFile(encPath+sigFileExt, []byte("not a real signature"), 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := openpgp.EntityList{signer}
+	if err := DecryptDirFilesVerified(dir, key, keyring); err == nil {
+		t.Error("expected a bogus signature to fail verification")
+	}
+
+}
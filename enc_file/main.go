@@ -1,10 +1,12 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"os"
 
 	"github.com/jasonmoo/cryp"
+	"golang.org/x/crypto/openpgp"
 )
 
 func main() {
@@ -14,10 +16,49 @@ func main() {
 		log.Fatal("CRYP_KEY not set in environment")
 	}
 
+	signer, err := loadSigner()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	for _, path := range os.Args[1:] {
+		if signer != nil {
+			if _, err := cryp.EncryptFileSigned(path, []byte(key), signer); err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
 		if _, err := cryp.EncryptFile(path, []byte(key)); err != nil {
 			log.Fatal(err)
 		}
 	}
 
 }
+
+// loadSigner reads the armored private key at CRYP_PGP_KEY, if set, and
+// returns its first entity. A nil signer and nil error means CRYP_PGP_KEY
+// wasn't set, so encrypted files go out unsigned.
+func loadSigner() (*openpgp.Entity, error) {
+
+	path, exists := os.LookupEnv("CRYP_PGP_KEY")
+	if !exists {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keyring, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyring) == 0 {
+		return nil, errors.New("cryp: no keys found in CRYP_PGP_KEY")
+	}
+
+	return keyring[0], nil
+
+}
@@ -0,0 +1,175 @@
+package cryp
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/rfjakob/eme"
+	"golang.org/x/crypto/scrypt"
+)
+
+// nameSalt is a fixed, distinct scrypt salt used only to derive the name
+// subkey, so rotating the name key never requires touching file contents
+// and vice versa.
+var nameSalt = []byte("cryp-name-subkey-v1")
+
+// base32NameEnc produces filesystem-safe, unpadded names. Its output is
+// uppercase; callers lowercase it before use.
+var base32NameEnc = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// encNamePrefix marks a name as encryptNameTweaked's output rather than an
+// ordinary plaintext name that happens to be all lowercase letters and
+// digits 2-7 - which is most of them. "0" never appears in base32NameEnc's
+// own alphabet, so no legitimate ciphertext name can collide with this
+// prefix, and decryptDirTree relies on that to tell a name that was never
+// encrypted (skip it) apart from one that looks encrypted but fails to
+// decrypt (a real error, not a plain name).
+const encNamePrefix = "0"
+
+// base32NameRegexp matches the names EncryptName produces.
+var base32NameRegexp = regexp.MustCompile(`^` + encNamePrefix + `[a-z2-7]+$`)
+
+const (
+	// emeBlockSize is the AES/EME block size that tweaks and padded names
+	// must be a multiple of.
+	emeBlockSize = 16
+	// maxNameBlocks is the largest input EME can operate on in one call.
+	maxNameBlocks = 128
+)
+
+// EncryptName encrypts a single path segment (a file or directory name, not
+// a full path) with AES-256 in EME (ECB-Mix-ECB) mode and returns it
+// base32-encoded (RFC 4648 without padding, lowercased) and prefixed with
+// encNamePrefix, so the result is safe to use as a filesystem path
+// component and recognizable as cryp ciphertext rather than an ordinary
+// name. Because EME is deterministic, the same name under the same key
+// always produces the same ciphertext; EncryptDirFiles additionally tweaks
+// each directory's entries with an HMAC of that directory's own name, so
+// identical names in differently named directories don't. Directories that
+// share a name (a/x and b/x) share a tweak, so identical names inside them
+// still produce identical ciphertext.
+func EncryptName(name string, key []byte) (string, error) {
+	nameKey, err := deriveNameKey(key)
+	if err != nil {
+		return "", err
+	}
+	return encryptNameTweaked(name, nameKey, zeroTweak())
+}
+
+// DecryptName reverses EncryptName.
+func DecryptName(name string, key []byte) (string, error) {
+	nameKey, err := deriveNameKey(key)
+	if err != nil {
+		return "", err
+	}
+	return decryptNameTweaked(name, nameKey, zeroTweak())
+}
+
+func zeroTweak() []byte {
+	return make([]byte, emeBlockSize)
+}
+
+// deriveNameKey derives the AES-256 subkey used to encrypt file and
+// directory names from the master key via scrypt, using a salt distinct
+// from the one used for content encryption.
+func deriveNameKey(key []byte) ([]byte, error) {
+	return scrypt.Key(key, nameSalt, scryptN, scryptR, scryptP, aesKeyLen)
+}
+
+// dirTweak derives the 16-byte EME tweak used for every entry directly
+// inside a directory, from an HMAC of dirName - that directory's own
+// plaintext name, keyed with the name subkey. The root directory passed to
+// EncryptDirFiles is never itself renamed, only its contents are, and every
+// subdirectory's plaintext name is known when it is walked, so dirName is always
+// recoverable: at the tree root it's simply the root's own basename, and at
+// each level down it's the plaintext name a subdirectory had just before
+// its own contents were encrypted. Deriving the tweak from only this one
+// path component - rather than the directory's full path, encrypted or
+// not - means it depends on neither where the tree physically lives on
+// disk (moved wholesale, restored elsewhere, reached via a trailing
+// separator, ...) nor which ancestor EncryptDirFiles/DecryptDirFiles
+// happened to be invoked with.
+func dirTweak(nameKey []byte, dirName string) []byte {
+	h := hmac.New(sha256.New, nameKey)
+	h.Write([]byte(dirName))
+	return h.Sum(nil)[:emeBlockSize]
+}
+
+func encryptNameTweaked(name string, nameKey, tweak []byte) (string, error) {
+
+	block, err := aes.NewCipher(nameKey)
+	if err != nil {
+		return "", err
+	}
+
+	padded := pkcs7Pad([]byte(name), emeBlockSize)
+	if len(padded) > maxNameBlocks*emeBlockSize {
+		return "", errors.New("cryp: name too long to encrypt")
+	}
+
+	ciphertext := eme.New(block).Encrypt(tweak, padded)
+
+	return encNamePrefix + strings.ToLower(base32NameEnc.EncodeToString(ciphertext)), nil
+
+}
+
+func decryptNameTweaked(name string, nameKey, tweak []byte) (string, error) {
+
+	if !strings.HasPrefix(name, encNamePrefix) {
+		return "", errors.New("cryp: not an encrypted name")
+	}
+
+	block, err := aes.NewCipher(nameKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := base32NameEnc.DecodeString(strings.ToUpper(strings.TrimPrefix(name, encNamePrefix)))
+	if err != nil {
+		return "", err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%emeBlockSize != 0 {
+		return "", errors.New("cryp: invalid encrypted name")
+	}
+
+	padded := eme.New(block).Decrypt(tweak, ciphertext)
+
+	return pkcs7Unpad(padded)
+
+}
+
+// pkcs7Pad pads data to a multiple of blockSize per PKCS#7 (RFC 5652 6.3).
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	padLen := blockSize - len(data)%blockSize
+	padded := make([]byte, len(data)+padLen)
+	copy(padded, data)
+	for i := len(data); i < len(padded); i++ {
+		padded[i] = byte(padLen)
+	}
+	return padded
+}
+
+func pkcs7Unpad(data []byte) (string, error) {
+
+	if len(data) == 0 || len(data)%emeBlockSize != 0 {
+		return "", errors.New("cryp: invalid padded name")
+	}
+
+	padLen := int(data[len(data)-1])
+	if padLen == 0 || padLen > emeBlockSize || padLen > len(data) {
+		return "", errors.New("cryp: invalid padding")
+	}
+	for _, b := range data[len(data)-padLen:] {
+		if int(b) != padLen {
+			return "", errors.New("cryp: invalid padding")
+		}
+	}
+
+	return string(data[:len(data)-padLen]), nil
+
+}
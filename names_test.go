@@ -0,0 +1,77 @@
+package cryp
+
+import (
+	"testing"
+)
+
+func TestEncDecName(t *testing.T) {
+
+	key := []byte("key")
+
+	testset := []string{
+		"normal.txt",
+		"",
+		"a",
+		"a name with spaces.jpg",
+		"utf8 name ∆∆.bin",
+	}
+
+	for _, name := range testset {
+
+		encName, err := EncryptName(name, key)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if !base32NameRegexp.MatchString(encName) {
+			t.Errorf("Expected a lowercase base32 name, got %q", encName)
+		}
+
+		decName, err := DecryptName(encName, key)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if decName != name {
+			t.Errorf("Expected %q, got %q", name, decName)
+		}
+
+	}
+
+}
+
+func TestEncryptNameDeterministicPerTweak(t *testing.T) {
+
+	key := []byte("key")
+	nameKey, err := deriveNameKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tweakA := dirTweak(nameKey, "/some/dir")
+	tweakB := dirTweak(nameKey, "/some/other/dir")
+
+	a, err := encryptNameTweaked("normal.txt", nameKey, tweakA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := encryptNameTweaked("normal.txt", nameKey, tweakB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a == b {
+		t.Errorf("Expected different ciphertext names for the same name under different directory tweaks")
+	}
+
+	again, err := encryptNameTweaked("normal.txt", nameKey, tweakA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != again {
+		t.Errorf("Expected the same ciphertext name for the same name and tweak")
+	}
+
+}
@@ -0,0 +1,355 @@
+// Package repo turns a directory of files into a deduplicated, encrypted
+// object store, in the spirit of restic: files are split into
+// content-defined chunks, each unique chunk is encrypted and stored once,
+// and a snapshot records how to reassemble a tree from those chunks. Backing
+// up an unchanged multi-gigabyte tree after the first snapshot costs almost
+// nothing, since every chunk it contains is already on disk.
+package repo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jasonmoo/cryp"
+	"github.com/restic/chunker"
+)
+
+// chunkerPol is a fixed, pre-verified irreducible polynomial shared by every
+// repo. It must never change: two repos (or two backups of the same repo)
+// using different polynomials would split identical content into different
+// chunks, defeating deduplication.
+const chunkerPol = chunker.Pol(0x2310f5698aa7c1)
+
+const masterKeySize = 32 // AES-256
+
+// masterKeyFile is where the repo's random master key lives, wrapped with a
+// key derived from the caller's password so rotating the password never
+// requires touching the encrypted data.
+const masterKeyFile = "key"
+
+// Init creates a new repo at path: the data/, snapshots/, and keys/
+// directories, and a random master key wrapped with key. All chunk and
+// snapshot encryption uses the master key, not key directly.
+func Init(path string, key []byte) error {
+
+	for _, dir := range []string{"data", "snapshots", "keys"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0700); err != nil {
+			return err
+		}
+	}
+
+	masterKey := make([]byte, masterKeySize)
+	if _, err := io.ReadFull(rand.Reader, masterKey); err != nil {
+		return err
+	}
+
+	wrapped, err := cryp.Encrypt(masterKey, key)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(path, "keys", masterKeyFile), wrapped, 0600)
+
+}
+
+// fileEntry records one regular file's metadata and the ordered chunk IDs
+// (hex SHA-256 of each chunk's plaintext) needed to reassemble its contents.
+type fileEntry struct {
+	Path     string    `json:"path"`
+	Mode     uint32    `json:"mode"`
+	ModTime  time.Time `json:"mod_time"`
+	Size     int64     `json:"size"`
+	ChunkIDs []string  `json:"chunk_ids"`
+}
+
+// dirEntry records one directory's metadata so Restore can recreate empty
+// directories and restore permissions on non-empty ones.
+type dirEntry struct {
+	Path string `json:"path"`
+	Mode uint32 `json:"mode"`
+}
+
+// manifest is the (encrypted) contents of a snapshot.
+type manifest struct {
+	Time  time.Time   `json:"time"`
+	Dirs  []dirEntry  `json:"dirs"`
+	Files []fileEntry `json:"files"`
+}
+
+// Backup is BackupWithOptions with cryp.DefaultOptions.
+func Backup(srcDir, repoPath string, key []byte) (string, error) {
+	return BackupWithOptions(srcDir, repoPath, key, cryp.DefaultOptions())
+}
+
+// BackupWithOptions walks srcDir, splits each file into content-defined
+// chunks with a Rabin fingerprint rolling hash (~1 MiB average, 512 KiB
+// min, 8 MiB max), encrypts each chunk not already present in
+// repoPath/data with opts, and writes an encrypted snapshot manifest
+// describing how to reassemble the tree. It returns the new snapshot's ID.
+// A nil opts is equivalent to cryp.DefaultOptions. Chunks are deduplicated
+// by the SHA-256 of their plaintext, so opts (compression included) has no
+// effect on which chunks storeChunk finds already on disk.
+func BackupWithOptions(srcDir, repoPath string, key []byte, opts *cryp.Options) (string, error) {
+
+	masterKey, err := unwrapMasterKey(repoPath, key)
+	if err != nil {
+		return "", err
+	}
+
+	m := manifest{Time: time.Now()}
+
+	err = filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		switch {
+		case info.IsDir():
+			m.Dirs = append(m.Dirs, dirEntry{Path: rel, Mode: uint32(info.Mode().Perm())})
+
+		case info.Mode().IsRegular():
+			chunkIDs, err := storeFileChunks(path, repoPath, masterKey, opts)
+			if err != nil {
+				return err
+			}
+			m.Files = append(m.Files, fileEntry{
+				Path:     rel,
+				Mode:     uint32(info.Mode().Perm()),
+				ModTime:  info.ModTime(),
+				Size:     info.Size(),
+				ChunkIDs: chunkIDs,
+			})
+
+		default:
+			// symlinks, named pipes, sockets, and devices are not yet
+			// supported by the repo format
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return writeSnapshot(repoPath, masterKey, &m)
+
+}
+
+// storeFileChunks splits path into content-defined chunks, writes any that
+// aren't already present in repoPath/data, and returns their IDs in order.
+func storeFileChunks(path, repoPath string, masterKey []byte, opts *cryp.Options) ([]string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var chunkIDs []string
+
+	ch := chunker.New(f, chunkerPol)
+	buf := make([]byte, chunker.MaxSize)
+	for {
+		chunk, err := ch.Next(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		id := hex.EncodeToString(sha256Sum(chunk.Data))
+		chunkIDs = append(chunkIDs, id)
+
+		if err := storeChunk(repoPath, masterKey, id, chunk.Data, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	return chunkIDs, nil
+
+}
+
+// storeChunk writes plaintext, encrypted with masterKey per opts, to
+// repoPath/data/<id[:2]>/<id>, unless that chunk is already on disk.
+func storeChunk(repoPath string, masterKey []byte, id string, plaintext []byte, opts *cryp.Options) error {
+
+	dir := filepath.Join(repoPath, "data", id[:2])
+	dst := filepath.Join(dir, id)
+
+	if _, err := os.Stat(dst); err == nil {
+		return nil // already deduplicated
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-"+id)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := cryp.EncryptStreamWithOptions(tmp, bytes.NewReader(plaintext), masterKey, opts); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+
+}
+
+// writeSnapshot encrypts m and writes it to repoPath/snapshots/<id>, where
+// id is the hex SHA-256 of the encrypted manifest.
+func writeSnapshot(repoPath string, masterKey []byte, m *manifest) (string, error) {
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := cryp.Encrypt(data, masterKey)
+	if err != nil {
+		return "", err
+	}
+
+	id := hex.EncodeToString(sha256Sum(encrypted))
+
+	if err := os.WriteFile(filepath.Join(repoPath, "snapshots", id), encrypted, 0600); err != nil {
+		return "", err
+	}
+
+	return id, nil
+
+}
+
+// Restore reverses Backup: it reads the snapshot named snapshotID from
+// repoPath, recreates its directories and files under dstDir, and
+// reassembles each file from its chunks in order.
+func Restore(snapshotID, dstDir, repoPath string, key []byte) error {
+
+	masterKey, err := unwrapMasterKey(repoPath, key)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := os.ReadFile(filepath.Join(repoPath, "snapshots", snapshotID))
+	if err != nil {
+		return err
+	}
+
+	data, err := cryp.Decrypt(encrypted, masterKey)
+	if err != nil {
+		return err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	for _, d := range m.Dirs {
+		if err := os.MkdirAll(filepath.Join(dstDir, d.Path), os.FileMode(d.Mode)); err != nil {
+			return err
+		}
+	}
+
+	for _, fe := range m.Files {
+		if err := restoreFile(dstDir, repoPath, masterKey, &fe); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// restoreFile recreates one file from its ordered chunks.
+func restoreFile(dstDir, repoPath string, masterKey []byte, fe *fileEntry) error {
+
+	dst := filepath.Join(dstDir, fe.Path)
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(fe.Mode))
+	if err != nil {
+		return err
+	}
+
+	for _, id := range fe.ChunkIDs {
+		if err := appendChunk(out, repoPath, masterKey, id); err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, time.Now(), fe.ModTime)
+
+}
+
+// appendChunk decrypts repoPath/data/<id[:2]>/<id> and writes its plaintext
+// to dst.
+func appendChunk(dst io.Writer, repoPath string, masterKey []byte, id string) error {
+
+	src, err := os.Open(filepath.Join(repoPath, "data", id[:2], id))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return cryp.DecryptStream(dst, src, masterKey)
+
+}
+
+// unwrapMasterKey reads and decrypts repoPath's master key with key.
+func unwrapMasterKey(repoPath string, key []byte) ([]byte, error) {
+
+	wrapped, err := os.ReadFile(filepath.Join(repoPath, "keys", masterKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	masterKey, err := cryp.Decrypt(wrapped, key)
+	if err != nil {
+		return nil, fmt.Errorf("repo: wrong key or corrupt repo: %w", err)
+	}
+	if len(masterKey) != masterKeySize {
+		return nil, errors.New("repo: corrupt master key")
+	}
+
+	return masterKey, nil
+
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
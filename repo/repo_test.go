@@ -0,0 +1,136 @@
+package repo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitBackupRestore(t *testing.T) {
+
+	key := []byte("key")
+
+	root, err := os.MkdirTemp("", "cryp-repo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	repoPath := filepath.Join(root, "repo")
+	srcDir := filepath.Join(root, "src")
+	dstDir := filepath.Join(root, "dst")
+
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// big.bin (~15 MiB) is larger than the chunker's 8 MiB maximum chunk
+	// size, so it is split into multiple chunks.
+	big := bytes.Repeat([]byte("cryp repo chunking test data. "), 1<<19)
+	if err := os.WriteFile(filepath.Join(srcDir, "big.bin"), big, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "sub", "small.txt"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Init(repoPath, key); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshotID, err := Backup(srcDir, repoPath, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chunkFiles int
+	if err := filepath.Walk(filepath.Join(repoPath, "data"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			chunkFiles++
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// small.txt accounts for one chunk file; big.bin for the rest.
+	if chunkFiles < 3 {
+		t.Errorf("Expected big.bin to be split into at least 2 chunks, found %d chunk files", chunkFiles)
+	}
+
+	if err := Restore(snapshotID, dstDir, repoPath, key); err != nil {
+		t.Fatal(err)
+	}
+
+	gotBig, err := os.ReadFile(filepath.Join(dstDir, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotBig, big) {
+		t.Errorf("big.bin contents mismatch after restore")
+	}
+
+	gotSmall, err := os.ReadFile(filepath.Join(dstDir, "sub", "small.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotSmall) != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", gotSmall)
+	}
+
+	// a second backup of the identical tree must not store any new chunks
+	if _, err := Backup(srcDir, repoPath, key); err != nil {
+		t.Fatal(err)
+	}
+	var chunkFilesAfter int
+	if err := filepath.Walk(filepath.Join(repoPath, "data"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			chunkFilesAfter++
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if chunkFilesAfter != chunkFiles {
+		t.Errorf("Expected unchanged tree to add no new chunks, had %d, now %d", chunkFiles, chunkFilesAfter)
+	}
+
+}
+
+func TestRestoreWrongKey(t *testing.T) {
+
+	root, err := os.MkdirTemp("", "cryp-repo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	repoPath := filepath.Join(root, "repo")
+	srcDir := filepath.Join(root, "src")
+
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "f.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Init(repoPath, []byte("right key")); err != nil {
+		t.Fatal(err)
+	}
+	snapshotID, err := Backup(srcDir, repoPath, []byte("right key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Restore(snapshotID, filepath.Join(root, "dst"), repoPath, []byte("wrong key")); err == nil {
+		t.Errorf("Expected an error restoring with the wrong key")
+	}
+
+}
@@ -0,0 +1,46 @@
+// Package sign adds optional OpenPGP signing of cryp's encrypted output.
+// The streaming AEAD's tags and cryp's HMAC file names only prove the
+// ciphertext wasn't corrupted and that its holder knew the shared
+// password - they say nothing about who
+// produced it. A detached signature over the same ciphertext lets a
+// recipient additionally verify it came from a specific, known key.
+package sign
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// errNoSignature is returned by VerifyEncrypted when signature is empty. A
+// non-empty signature that can't be parsed fails with openpgp's own error.
+var errNoSignature = errors.New("cryp/sign: no signature found")
+
+// SignEncrypted produces a detached OpenPGP signature over ciphertext,
+// signed with signer's private key. The signature is independent of
+// cryp's own HMAC and AEAD tags; it proves provenance, not integrity.
+func SignEncrypted(ciphertext []byte, signer *openpgp.Entity) ([]byte, error) {
+
+	buf := &bytes.Buffer{}
+	if err := openpgp.DetachSign(buf, signer, bytes.NewReader(ciphertext), nil); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+
+}
+
+// VerifyEncrypted checks signature as a detached OpenPGP signature over
+// ciphertext, made by a key in keyring. It returns nil only if the
+// signature verifies against an entity in keyring.
+func VerifyEncrypted(ciphertext, signature []byte, keyring openpgp.EntityList) error {
+
+	if len(signature) == 0 {
+		return errNoSignature
+	}
+
+	_, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(ciphertext), bytes.NewReader(signature))
+	return err
+
+}
@@ -0,0 +1,77 @@
+package sign
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func newTestEntity(t *testing.T) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("cryp test", "", "cryp-test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+func TestSignVerifyEncrypted(t *testing.T) {
+
+	entity := newTestEntity(t)
+	ciphertext := []byte("pretend this is AEAD ciphertext")
+
+	signature, err := SignEncrypted(ciphertext, entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyEncrypted(ciphertext, signature, openpgp.EntityList{entity}); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func TestVerifyEncryptedTamperedCiphertext(t *testing.T) {
+
+	entity := newTestEntity(t)
+	ciphertext := []byte("pretend this is AEAD ciphertext")
+
+	signature, err := SignEncrypted(ciphertext, entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, ciphertext...)
+	tampered[0] ^= 0xff
+
+	if err := VerifyEncrypted(tampered, signature, openpgp.EntityList{entity}); err == nil {
+		t.Error("expected verification of tampered ciphertext to fail")
+	}
+
+}
+
+func TestVerifyEncryptedWrongKey(t *testing.T) {
+
+	signer := newTestEntity(t)
+	other := newTestEntity(t)
+	ciphertext := []byte("pretend this is AEAD ciphertext")
+
+	signature, err := SignEncrypted(ciphertext, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyEncrypted(ciphertext, signature, openpgp.EntityList{other}); err == nil {
+		t.Error("expected verification against the wrong key to fail")
+	}
+
+}
+
+func TestVerifyEncryptedNoSignature(t *testing.T) {
+
+	entity := newTestEntity(t)
+
+	if err := VerifyEncrypted([]byte("ciphertext"), nil, openpgp.EntityList{entity}); err == nil {
+		t.Error("expected an empty signature to fail verification")
+	}
+
+}
@@ -0,0 +1,472 @@
+package cryp
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// streamMagicV1 is the original streaming header: magic bytes, a fixed
+// scrypt cost baked into the package constants, and AES-256-GCM as the only
+// cipher. DecryptStream still reads it so files written before streamMagicV2
+// existed keep decrypting correctly.
+var streamMagicV1 = [8]byte{'C', 'R', 'Y', 'P', 0, 0, 0, 1}
+
+// streamMagicV2 is the current streaming header: it adds the scrypt cost
+// parameters and the chosen cipher to the header itself, so either can be
+// changed per file - tuning scrypt upward over time, say - without touching
+// the format or breaking files written with the old cost.
+var streamMagicV2 = [8]byte{'C', 'R', 'Y', 'P', 0, 0, 0, 2}
+
+const (
+	// StreamSaltSize is the length of the random salt written after the
+	// magic header. It doubles as the scrypt salt and, truncated, as the
+	// base nonce for every block in the stream.
+	StreamSaltSize = 24
+
+	// StreamBlockSize is the largest amount of plaintext sealed into a
+	// single block.
+	StreamBlockSize = 64 << 10
+
+	streamNonceSize = 12 // both AES-GCM and ChaCha20-Poly1305 use a 12-byte nonce
+
+	// streamFlagCompressed marks a v2 stream whose plaintext was gzipped
+	// before it was split into blocks.
+	streamFlagCompressed = 1 << 0
+)
+
+// Cipher selects the AEAD EncryptStreamWithOptions seals blocks with. The
+// zero value is CipherAES256GCM. A zero Options is not usable on its own:
+// its scrypt cost fields are zero, which scrypt rejects.
+type Cipher byte
+
+const (
+	// CipherAES256GCM seals blocks with AES-256 in GCM mode.
+	CipherAES256GCM Cipher = iota
+	// CipherChaCha20Poly1305 seals blocks with ChaCha20-Poly1305, useful on
+	// hardware without AES-NI.
+	CipherChaCha20Poly1305
+)
+
+// Options controls how EncryptStreamWithOptions writes a stream: which AEAD
+// to seal blocks with, how expensive the scrypt key derivation is, and
+// whether to gzip the plaintext before encrypting it.
+type Options struct {
+	Cipher   Cipher
+	ScryptN  int
+	ScryptR  int
+	ScryptP  int
+	Compress bool
+}
+
+// DefaultOptions returns the Options EncryptStream uses: AES-256-GCM, the
+// package's standard scrypt cost, and no compression.
+func DefaultOptions() *Options {
+	return &Options{
+		Cipher:  CipherAES256GCM,
+		ScryptN: scryptN,
+		ScryptR: scryptR,
+		ScryptP: scryptP,
+	}
+}
+
+// errTruncated is returned for any block that fails to authenticate,
+// whether because it was bit-flipped or because the stream was cut short.
+// Decryption never emits the unauthenticated plaintext of a failing block.
+var errTruncated = errors.New("cryp: truncated or tampered stream")
+
+// EncryptStream reads all of src and writes an authenticated, chunked
+// ciphertext to dst using DefaultOptions. See EncryptStreamWithOptions.
+func EncryptStream(dst io.Writer, src io.Reader, key []byte) error {
+	return EncryptStreamWithOptions(dst, src, key, DefaultOptions())
+}
+
+// EncryptStreamWithOptions reads all of src and writes an authenticated,
+// chunked ciphertext to dst: an 8-byte magic/version header, opts' cipher
+// and scrypt cost, a random salt, then a sequence of independently sealed
+// blocks of at most StreamBlockSize plaintext bytes each. Every block is
+// sealed with opts.Cipher using a nonce derived by XORing the file salt
+// with a little-endian block counter, so no single block's ciphertext can
+// be replayed into another position. Because each block carries its own
+// tag, arbitrarily large files can be encrypted without ever holding more
+// than one block in memory. A nil opts is equivalent to DefaultOptions.
+func EncryptStreamWithOptions(dst io.Writer, src io.Reader, key []byte, opts *Options) error {
+
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+
+	salt := make([]byte, StreamSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+
+	aead, err := newStreamAEAD(key, salt, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := writeStreamHeaderV2(dst, salt, opts); err != nil {
+		return err
+	}
+
+	if opts.Compress {
+		plain := src
+		pr, pw := io.Pipe()
+		go func() {
+			gw := gzip.NewWriter(pw)
+			if _, err := io.Copy(gw, plain); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			pw.CloseWithError(gw.Close())
+		}()
+		src = pr
+	}
+
+	return sealStreamBlocks(dst, src, aead, salt)
+
+}
+
+// DecryptStream reverses EncryptStream or EncryptStreamWithOptions,
+// verifying every block's tag before writing its plaintext to dst. A
+// bit-flip, reordering, or truncation is caught at the block that exposes
+// it and no unauthenticated plaintext is ever written. It reads both the
+// original AES-256-GCM-only header and the current header that carries its
+// own cipher and scrypt cost, so files written by either version of
+// EncryptStream decrypt correctly.
+func DecryptStream(dst io.Writer, src io.Reader, key []byte) error {
+
+	var header [8]byte
+	if _, err := io.ReadFull(src, header[:]); err != nil {
+		return err
+	}
+
+	switch header {
+	case streamMagicV1:
+		return decryptStreamV1(dst, src, key)
+	case streamMagicV2:
+		return decryptStreamV2(dst, src, key)
+	default:
+		return errors.New("cryp: unrecognized stream header")
+	}
+
+}
+
+// decryptStreamV1 reverses the original header: a salt, then AES-256-GCM
+// blocks keyed directly off the package's fixed scrypt cost constants.
+func decryptStreamV1(dst io.Writer, src io.Reader, key []byte) error {
+
+	salt := make([]byte, StreamSaltSize)
+	if _, err := io.ReadFull(src, salt); err != nil {
+		return err
+	}
+
+	aead, err := newLegacyStreamAEAD(key, salt)
+	if err != nil {
+		return err
+	}
+
+	return openStreamBlocks(dst, src, aead, salt)
+
+}
+
+// newLegacyStreamAEAD reproduces the very first streaming AEAD exactly:
+// the scrypt output, at the package's fixed cost constants, is used
+// directly as the AES-256-GCM key with no HKDF step. It exists solely so
+// streamMagicV1 files keep decrypting; new files always go through
+// newStreamAEAD.
+func newLegacyStreamAEAD(key, salt []byte) (cipher.AEAD, error) {
+
+	dkey, err := scrypt.Key(key, salt, scryptN, scryptR, scryptP, aesKeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(dkey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+
+}
+
+// decryptStreamV2 reverses writeStreamHeaderV2: it reads the cipher,
+// scrypt cost, and salt the file was written with, then authenticates and
+// writes every block, gunzipping the result first if the stream was
+// compressed.
+func decryptStreamV2(dst io.Writer, src io.Reader, key []byte) error {
+
+	opts, salt, err := readStreamHeaderV2(src)
+	if err != nil {
+		return err
+	}
+
+	aead, err := newStreamAEAD(key, salt, opts)
+	if err != nil {
+		return err
+	}
+
+	if !opts.Compress {
+		return openStreamBlocks(dst, src, aead, salt)
+	}
+
+	pr, pw := io.Pipe()
+	decErr := make(chan error, 1)
+	go func() {
+		gr, err := gzip.NewReader(pr)
+		if err != nil {
+			pr.CloseWithError(err)
+			decErr <- err
+			return
+		}
+		_, err = io.Copy(dst, gr)
+		pr.CloseWithError(err)
+		decErr <- err
+	}()
+
+	if err := openStreamBlocks(pw, src, aead, salt); err != nil {
+		pw.CloseWithError(err)
+		<-decErr
+		return err
+	}
+	pw.Close()
+	return <-decErr
+
+}
+
+// writeStreamHeaderV2 writes the magic/version header, opts' cipher, flags,
+// and scrypt cost, and salt.
+func writeStreamHeaderV2(dst io.Writer, salt []byte, opts *Options) error {
+
+	if _, err := dst.Write(streamMagicV2[:]); err != nil {
+		return err
+	}
+
+	var flags byte
+	if opts.Compress {
+		flags |= streamFlagCompressed
+	}
+	if _, err := dst.Write([]byte{byte(opts.Cipher), flags}); err != nil {
+		return err
+	}
+
+	var cost [12]byte
+	binary.BigEndian.PutUint32(cost[0:4], uint32(opts.ScryptN))
+	binary.BigEndian.PutUint32(cost[4:8], uint32(opts.ScryptR))
+	binary.BigEndian.PutUint32(cost[8:12], uint32(opts.ScryptP))
+	if _, err := dst.Write(cost[:]); err != nil {
+		return err
+	}
+
+	_, err := dst.Write(salt)
+	return err
+
+}
+
+// readStreamHeaderV2 reads the cipher, flags, scrypt cost, and salt
+// following a streamMagicV2 header.
+func readStreamHeaderV2(src io.Reader) (opts *Options, salt []byte, err error) {
+
+	var cipherAndFlags [2]byte
+	if _, err := io.ReadFull(src, cipherAndFlags[:]); err != nil {
+		return nil, nil, err
+	}
+
+	var cost [12]byte
+	if _, err := io.ReadFull(src, cost[:]); err != nil {
+		return nil, nil, err
+	}
+
+	salt = make([]byte, StreamSaltSize)
+	if _, err := io.ReadFull(src, salt); err != nil {
+		return nil, nil, err
+	}
+
+	opts = &Options{
+		Cipher:   Cipher(cipherAndFlags[0]),
+		Compress: cipherAndFlags[1]&streamFlagCompressed != 0,
+		ScryptN:  int(binary.BigEndian.Uint32(cost[0:4])),
+		ScryptR:  int(binary.BigEndian.Uint32(cost[4:8])),
+		ScryptP:  int(binary.BigEndian.Uint32(cost[8:12])),
+	}
+
+	return opts, salt, nil
+
+}
+
+// sealStreamBlocks reads src in StreamBlockSize chunks, seals each with
+// aead, and writes the length-prefixed blocks to dst.
+func sealStreamBlocks(dst io.Writer, src io.Reader, aead cipher.AEAD, salt []byte) error {
+
+	br := bufio.NewReaderSize(src, StreamBlockSize)
+	buf := make([]byte, StreamBlockSize)
+
+	var counter uint64
+	for {
+		n, rerr := io.ReadFull(br, buf)
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			return rerr
+		}
+
+		// A block is final when nothing remains to be read after it. This
+		// is decided the same way on decrypt so both sides agree on which
+		// blocks were sealed with the final flag set.
+		_, peekErr := br.Peek(1)
+		final := peekErr != nil
+
+		sealed := aead.Seal(nil, streamBlockNonce(salt, counter), buf[:n], streamBlockAAD(final))
+		if err := writeStreamBlock(dst, sealed); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+		counter++
+	}
+
+}
+
+// openStreamBlocks reads length-prefixed blocks from src, authenticates
+// each with aead, and writes its plaintext to dst.
+func openStreamBlocks(dst io.Writer, src io.Reader, aead cipher.AEAD, salt []byte) error {
+
+	br := bufio.NewReader(src)
+
+	var counter uint64
+	for {
+		sealed, final, err := readStreamBlock(br)
+		if err != nil {
+			return err
+		}
+
+		plain, err := aead.Open(nil, streamBlockNonce(salt, counter), sealed, streamBlockAAD(final))
+		if err != nil {
+			return errTruncated
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+		counter++
+	}
+
+}
+
+// writeStreamBlock writes a big-endian length prefix followed by sealed.
+func writeStreamBlock(dst io.Writer, sealed []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(sealed)))
+	if _, err := dst.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := dst.Write(sealed)
+	return err
+}
+
+// readStreamBlock reads one length-prefixed ciphertext block and reports
+// whether it is the last block in the stream, mirroring the peek that
+// sealStreamBlocks performs when it writes the block.
+func readStreamBlock(br *bufio.Reader) (sealed []byte, final bool, err error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(br, lenBuf[:]); err != nil {
+		return nil, false, errTruncated
+	}
+
+	sealed = make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+	if _, err := io.ReadFull(br, sealed); err != nil {
+		return nil, false, errTruncated
+	}
+
+	_, peekErr := br.Peek(1)
+	return sealed, peekErr != nil, nil
+}
+
+// streamBlockNonce derives the per-block AEAD nonce by XORing the file
+// salt's leading streamNonceSize bytes with the little-endian block
+// counter.
+func streamBlockNonce(salt []byte, counter uint64) []byte {
+	nonce := make([]byte, streamNonceSize)
+	copy(nonce, salt[:streamNonceSize])
+
+	var ctrBuf [8]byte
+	binary.LittleEndian.PutUint64(ctrBuf[:], counter)
+	for i, b := range ctrBuf {
+		nonce[i] ^= b
+	}
+
+	return nonce
+}
+
+// streamBlockAAD binds a block's tag to its position as the final block or
+// not, so a truncated stream can't be passed off as one that ended cleanly.
+func streamBlockAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// newStreamAEAD derives the AEAD opts.Cipher seals and opens blocks with.
+// key and salt first go through scrypt at opts' cost, same as before; the
+// scrypt output is then expanded with HKDF-SHA256, using an info string
+// specific to opts.Cipher, into the actual cipher key. The HKDF step is
+// what used to be a second, independently-derived HMAC subkey back when
+// blocks were sealed with AES-CFB and authenticated separately - now that
+// a single AEAD provides both confidentiality and integrity there is only
+// one key left to derive, but it is still kept one hop removed from the
+// raw scrypt output, and distinct per cipher, rather than using that output
+// directly.
+func newStreamAEAD(key, salt []byte, opts *Options) (cipher.AEAD, error) {
+
+	scryptOut, err := scrypt.Key(key, salt, opts.ScryptN, opts.ScryptR, opts.ScryptP, aesKeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	dkey := make([]byte, aesKeyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, scryptOut, nil, streamHKDFInfo(opts.Cipher)), dkey); err != nil {
+		return nil, err
+	}
+
+	switch opts.Cipher {
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(dkey)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(dkey)
+	default:
+		return nil, fmt.Errorf("cryp: unrecognized cipher %d", opts.Cipher)
+	}
+
+}
+
+// streamHKDFInfo returns the HKDF info string for c, so each cipher expands
+// the same scrypt output into a different key.
+func streamHKDFInfo(c Cipher) []byte {
+	switch c {
+	case CipherChaCha20Poly1305:
+		return []byte("cryp stream key v2: chacha20poly1305")
+	default:
+		return []byte("cryp stream key v2: aes-256-gcm")
+	}
+}
@@ -0,0 +1,79 @@
+package cryp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncryptStreamWithOptions(t *testing.T) {
+
+	key := []byte("key")
+	data := []byte(strings.Repeat("options roundtrip data ", 1<<12))
+
+	testset := []*Options{
+		{Cipher: CipherAES256GCM, ScryptN: scryptN, ScryptR: scryptR, ScryptP: scryptP},
+		{Cipher: CipherChaCha20Poly1305, ScryptN: scryptN, ScryptR: scryptR, ScryptP: scryptP},
+		{Cipher: CipherAES256GCM, ScryptN: scryptN, ScryptR: scryptR, ScryptP: scryptP, Compress: true},
+		{Cipher: CipherChaCha20Poly1305, ScryptN: scryptN, ScryptR: scryptR, ScryptP: scryptP, Compress: true},
+	}
+
+	for _, opts := range testset {
+
+		encrypted, err := EncryptWithOptions(data, key, opts)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if opts.Compress && len(encrypted) >= len(data) {
+			t.Errorf("Expected compressed output to be smaller than input")
+		}
+
+		decrypted, err := Decrypt(encrypted, key)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Errorf("output mismatch for %+v", opts)
+		}
+
+	}
+
+}
+
+// TestDecryptLegacyStream ensures ciphertext written with the original
+// AES-256-GCM-only header (before scrypt cost and cipher choice moved into
+// the header) still decrypts, so upgrading doesn't strand old files.
+func TestDecryptLegacyStream(t *testing.T) {
+
+	key := []byte("key")
+	data := []byte("legacy format data")
+
+	salt := make([]byte, StreamSaltSize)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+
+	aead, err := newLegacyStreamAEAD(key, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(streamMagicV1[:])
+	buf.Write(salt)
+	if err := sealStreamBlocks(buf, bytes.NewReader(data), aead, salt); err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := Decrypt(buf.Bytes(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Errorf("Expected %q, got %q", data, decrypted)
+	}
+
+}
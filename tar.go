@@ -0,0 +1,146 @@
+package cryp
+
+import (
+	"archive/tar"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// xattrPAXPrefix is the de facto standard (used by GNU tar and bsdtar) for
+// storing an extended attribute in a PAX extended header record: the
+// attribute's name, prefixed, as the key, and its raw value as the value.
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// writeTarEntry writes a full POSIX tar header for path - regular file,
+// symlink, or directory - under name, including ownership and any extended
+// attributes, then copies path's contents if it's a regular file.
+func writeTarEntry(tw *tar.Writer, name, path string, info os.FileInfo) error {
+
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		l, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		link = l
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+
+	if uid, gid, ok := fileOwner(info); ok {
+		hdr.Uid = uid
+		hdr.Gid = gid
+		if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			hdr.Uname = u.Username
+		}
+		if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+			hdr.Gname = g.Name
+		}
+	}
+
+	if xattrs, err := listXattrs(path); err == nil && len(xattrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(xattrs))
+		for name, value := range xattrs {
+			hdr.PAXRecords[xattrPAXPrefix+name] = string(value)
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+
+}
+
+// applyTarMetadata restores the ownership and extended attributes recorded
+// in hdr onto the already-created path. Restoring ownership requires
+// running as root; a permission error doing so is not treated as fatal,
+// since the rest of the entry still restored correctly.
+func applyTarMetadata(path string, hdr *tar.Header) error {
+
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil && !os.IsPermission(err) {
+		return err
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, xattrPAXPrefix) {
+			continue
+		}
+		if err := setXattr(path, strings.TrimPrefix(key, xattrPAXPrefix), []byte(value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// encryptTarStream builds a tar archive with buildTar, streams it through
+// EncryptStreamWithOptions, and writes the ciphertext to a new file in dir,
+// named with the HMAC-SHA256 (keyed with key) of the encrypted output. It
+// returns the new file's path. EncryptFileWithOptions and encryptTree share
+// this so a single file and a whole directory tree are encrypted the same
+// way, differing only in what they write into the tar. A nil opts is
+// equivalent to DefaultOptions.
+func encryptTarStream(dir string, key []byte, opts *Options, buildTar func(tw *tar.Writer) error) (string, error) {
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		if err := buildTar(tw); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+
+	tmp_file, err := ioutil.TempFile(dir, ".cryp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp_file.Name())
+
+	h := hmac.New(sha256.New, key)
+	if err := EncryptStreamWithOptions(io.MultiWriter(tmp_file, h), pr, key, opts); err != nil {
+		tmp_file.Close()
+		return "", err
+	}
+	if err := tmp_file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp_file.Name(), 0400); err != nil {
+		return "", err
+	}
+
+	new_file_path := filepath.Join(dir, hex.EncodeToString(h.Sum(nil)))
+	if err := os.Rename(tmp_file.Name(), new_file_path); err != nil {
+		return "", err
+	}
+
+	return new_file_path, nil
+
+}
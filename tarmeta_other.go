@@ -0,0 +1,20 @@
+//go:build windows
+
+package cryp
+
+import "os"
+
+// fileOwner is a no-op on platforms without POSIX uid/gid ownership.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// listXattrs is a no-op on platforms without extended attributes.
+func listXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// setXattr is a no-op on platforms without extended attributes.
+func setXattr(path, name string, value []byte) error {
+	return nil
+}
@@ -0,0 +1,66 @@
+//go:build !windows
+
+package cryp
+
+import (
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileOwner reports the uid/gid path's FileInfo was stat'd with.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// listXattrs returns every extended attribute set on path, keyed by name.
+// A filesystem that doesn't support xattrs at all reports that through err;
+// callers that only care about best-effort metadata should ignore it.
+func listXattrs(path string) (map[string][]byte, error) {
+
+	size, err := unix.Listxattr(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	namebuf := make([]byte, size)
+	n, err := unix.Listxattr(path, namebuf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(namebuf[:n]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		vsize, err := unix.Getxattr(path, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, vsize)
+		if _, err := unix.Getxattr(path, name, value); err != nil {
+			continue
+		}
+
+		xattrs[name] = value
+	}
+
+	return xattrs, nil
+
+}
+
+// setXattr sets the extended attribute name on path to value.
+func setXattr(path, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}
@@ -0,0 +1,231 @@
+package cryp
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// zipManifestName is the name EncryptDirToZip gives the encrypted manifest
+// entry it writes last, listing every other entry's real path, mode, and
+// mod time.
+const zipManifestName = "_MANIFEST.cryp"
+
+// zipIDSize is the size, in bytes, of the random identifier EncryptDirToZip
+// gives each entry in place of its real name, so the zip's central
+// directory - readable by anyone who has the file, key or no key - reveals
+// nothing about the directory structure it holds.
+const zipIDSize = 16
+
+// zipManifestEntry records one file's real path (relative to the encrypted
+// directory's root) and the metadata needed to recreate it, since none of
+// that can live in the entry's own zip header without leaking it.
+type zipManifestEntry struct {
+	Name    string      `json:"name"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+}
+
+// EncryptDirToZip walks srcDir and writes outPath as a single zip archive -
+// conventionally named "*.cryp.zip" - holding one stored (uncompressed,
+// since it's already high-entropy ciphertext) entry per regular file below
+// srcDir, each sealed with the streaming AEAD format and named with a
+// random base32 identifier rather than its real path. A trailing
+// _MANIFEST.cryp entry, encrypted the same way, maps every identifier back
+// to its real path, mode, and mod time. The result is a standard zip that
+// tools without cryp can still open - they'll just find opaque ciphertext
+// under opaque names - while DecryptZipToDir can recreate every regular
+// file under its real path with its mode and mod time. Directories are
+// recreated only as parents of those files; empty directories, symlinks,
+// and other non-regular entries are not stored.
+func EncryptDirToZip(srcDir, outPath string, key []byte) error {
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+
+	var manifest []zipManifestEntry
+
+	err = filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+
+		id, err := randomZipID()
+		if err != nil {
+			return err
+		}
+
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: id, Method: zip.Store})
+		if err != nil {
+			return err
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		if err := EncryptStream(w, src, key); err != nil {
+			return err
+		}
+
+		manifest = append(manifest, zipManifestEntry{
+			Name:    filepath.ToSlash(rel),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		})
+
+		return nil
+
+	})
+	if err != nil {
+		zw.Close()
+		return err
+	}
+
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		zw.Close()
+		return err
+	}
+
+	encManifest, err := Encrypt(manifestData, key)
+	if err != nil {
+		zw.Close()
+		return err
+	}
+
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: zipManifestName, Method: zip.Store})
+	if err != nil {
+		zw.Close()
+		return err
+	}
+	if _, err := w.Write(encManifest); err != nil {
+		zw.Close()
+		return err
+	}
+
+	return zw.Close()
+
+}
+
+// DecryptZipToDir reverses EncryptDirToZip: it reads zipPath's manifest
+// entry to learn every other entry's real path, mode, and mod time, then
+// decrypts each in turn into dstDir. The manifest and the zip's entries are
+// paired up positionally - EncryptDirToZip writes both in the same order -
+// rather than by name, since an entry's zip name is only ever its random
+// identifier.
+func DecryptZipToDir(zipPath, dstDir string, key []byte) error {
+
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	var manifest []zipManifestEntry
+	entries := make([]*zip.File, 0, len(zr.File))
+
+	for _, f := range zr.File {
+		if f.Name == zipManifestName {
+			data, err := readZipEntry(f)
+			if err != nil {
+				return err
+			}
+			plain, err := Decrypt(data, key)
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(plain, &manifest); err != nil {
+				return err
+			}
+			continue
+		}
+		entries = append(entries, f)
+	}
+
+	if manifest == nil {
+		return errors.New("cryp: zip archive is missing its manifest")
+	}
+	if len(manifest) != len(entries) {
+		return fmt.Errorf("cryp: manifest lists %d entries, archive holds %d", len(manifest), len(entries))
+	}
+
+	for i, meta := range manifest {
+
+		dstPath := filepath.Join(dstDir, filepath.FromSlash(meta.Name))
+		if err := os.MkdirAll(filepath.Dir(dstPath), 0700); err != nil {
+			return err
+		}
+
+		rc, err := entries[i].Open()
+		if err != nil {
+			return err
+		}
+
+		dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, meta.Mode)
+		if err != nil {
+			rc.Close()
+			return err
+		}
+
+		err = DecryptStream(dst, rc, key)
+		rc.Close()
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := os.Chtimes(dstPath, time.Now(), meta.ModTime); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// readZipEntry reads f's entire decompressed contents.
+func readZipEntry(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// randomZipID returns a random, base32-encoded identifier of zipIDSize
+// bytes, suitable as a zip entry name that carries no information about
+// the file it holds.
+func randomZipID() (string, error) {
+	buf := make([]byte, zipIDSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32NameEnc.EncodeToString(buf)), nil
+}
@@ -0,0 +1,109 @@
+package cryp
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptDecryptDirToZip(t *testing.T) {
+
+	var key = []byte("key")
+
+	root, err := ioutil.TempDir(os.TempDir(), "test_enc_dec_zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcDir := filepath.Join(root, "src")
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "top.txt"), []byte("top level file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "sub", "nested.txt"), []byte("nested file"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	zipPath := filepath.Join(root, "out.cryp.zip")
+	if err := EncryptDirToZip(srcDir, zipPath, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// the zip's own entry names must not leak the original paths.
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if f.Name == "top.txt" || f.Name == filepath.ToSlash(filepath.Join("sub", "nested.txt")) {
+			zr.Close()
+			t.Fatalf("zip entry %q leaks the original file name", f.Name)
+		}
+	}
+	zr.Close()
+
+	dstDir := filepath.Join(root, "dst")
+	if err := DecryptZipToDir(zipPath, dstDir, key); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dstDir, "top.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("top level file")) {
+		t.Errorf("expected %q, got %q", "top level file", data)
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(dstDir, "sub", "nested.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("nested file")) {
+		t.Errorf("expected %q, got %q", "nested file", data)
+	}
+
+	info, err := os.Stat(filepath.Join(dstDir, "sub", "nested.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("expected mode %#o, got %#o", 0640, info.Mode().Perm())
+	}
+
+}
+
+func TestDecryptZipToDirMissingManifest(t *testing.T) {
+
+	var key = []byte("key")
+
+	root, err := ioutil.TempDir(os.TempDir(), "test_dec_zip_no_manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	zipPath := filepath.Join(root, "out.cryp.zip")
+	out, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(out)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DecryptZipToDir(zipPath, filepath.Join(root, "dst"), key); err == nil {
+		t.Error("expected an error decrypting a zip with no manifest")
+	}
+
+}